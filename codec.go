@@ -0,0 +1,76 @@
+package httprpc
+
+import (
+  "io"
+)
+
+// RequestReader exposes a single decoded JSON-RPC request envelope.
+// Params decoding is lazy: the codec has already resolved Method and
+// Id, but Decode is only called once the method's ArgType is known,
+// so codecs whose decoder needs a concrete destination type (e.g.
+// protobuf) never have to guess one.
+type RequestReader interface {
+  // Method returns the "Service.Method" name from the envelope.
+  Method() string
+  // Id returns the request's id exactly as the codec parsed it, or
+  // nil if the request is a notification. Codecs treat it as opaque
+  // and hand it back unchanged to WriteResponse.
+  Id() interface{}
+  // Decode unmarshals the request's params into into, which must be
+  // a pointer to the resolved method's ArgType.
+  Decode(into interface{}) error
+}
+
+// Codec implements the wire encoding for one Content-Type. A Server
+// can have several codecs registered at once, dispatching by the
+// request's Content-Type header, so a single Server can serve clients
+// that speak JSON alongside clients that speak BSON, protobuf, or
+// msgpack.
+type Codec interface {
+  // NewRequest parses the envelope (method, id, and an as-yet-undecoded
+  // params) out of r. A malformed envelope is reported as a
+  // *codecError so the caller can reply with the right JSON-RPC error
+  // code and (if known) id; any other error is treated as a parse
+  // error with an unknown id.
+  NewRequest(r io.Reader) (RequestReader, error)
+  // WriteResponse writes one response envelope to w, carrying either
+  // result or rpcErr (never both).
+  WriteResponse(w io.Writer, id interface{}, result interface{}, rpcErr *rpcError) error
+  // ContentType is the Content-Type header value a response encoded by
+  // this codec should be served under.
+  ContentType() string
+}
+
+// BatchCodec is implemented by codecs whose wire format supports
+// sending several requests in a single body (JSON-RPC 2.0 batches).
+// Codecs that don't implement it are only ever asked for one request
+// per HTTP request.
+type BatchCodec interface {
+  Codec
+  // SplitBatch inspects body and, if it encodes a batch, returns one
+  // reader per element and ok == true. If body is not a batch, ok is
+  // false and the caller should handle it as a single request instead.
+  SplitBatch(body []byte) (readers []io.Reader, ok bool, err error)
+  // WriteBatchResponse writes a set of responses produced from a
+  // batch back as a single body, preserving order.
+  WriteBatchResponse(w io.Writer, responses []batchResult) error
+}
+
+// batchResult is one element of a dispatched batch, kept until the
+// whole batch is ready so the codec can marshal it as a single body.
+type batchResult struct {
+  id     interface{}
+  result interface{}
+  rpcErr *rpcError
+}
+
+// codecError is returned by NewRequest when the envelope itself (not
+// the params) is malformed, carrying enough information to build a
+// spec-compliant error response.
+type codecError struct {
+  code    int
+  message string
+  id      interface{}
+}
+
+func (e *codecError) Error() string { return e.message }
@@ -0,0 +1,41 @@
+package httprpc
+
+import (
+  "context"
+  "net/http"
+  "reflect"
+)
+
+type contextKey int
+
+const (
+  headersContextKey contextKey = iota
+  idContextKey
+)
+
+// HeadersFromContext returns the HTTP headers of the request that led
+// to the current method call, as attached by ServeHTTP. ok is false if
+// ctx did not come from this package (e.g. in a unit test).
+func HeadersFromContext(ctx context.Context) (http.Header, bool) {
+  h, ok := ctx.Value(headersContextKey).(http.Header)
+  return h, ok
+}
+
+func withHeaders(ctx context.Context, h http.Header) context.Context {
+  return context.WithValue(ctx, headersContextKey, h)
+}
+
+// IdFromContext returns the JSON-RPC id of the request that led to the
+// current method call, or nil if it was a notification.
+func IdFromContext(ctx context.Context) interface{} {
+  return ctx.Value(idContextKey)
+}
+
+func withRequestId(ctx context.Context, id interface{}) context.Context {
+  if id == nil {
+    return ctx
+  }
+  return context.WithValue(ctx, idContextKey, id)
+}
+
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
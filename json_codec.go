@@ -0,0 +1,152 @@
+package httprpc
+
+import (
+  "bytes"
+  "encoding/json"
+  "io"
+  "io/ioutil"
+)
+
+// ContentTypeJSON is the Content-Type that the built-in jsonCodec is
+// registered under by NewServer.
+const ContentTypeJSON = "application/json"
+
+// jsonEnvelope is the wire shape of a single JSON-RPC 2.0 request
+// object.
+type jsonEnvelope struct {
+  Jsonrpc string          `json:"jsonrpc"`
+  Method  string          `json:"method"`
+  Params  json.RawMessage `json:"params,omitempty"`
+  // Id is left nil when the "id" member is absent, but set to the
+  // literal raw bytes "null" when it's present and explicitly null —
+  // those two cases must be told apart, since only the former makes
+  // this a notification. A *json.RawMessage can't make that
+  // distinction: encoding/json nils out a pointer field whenever the
+  // JSON value is null, regardless of whether the key was there.
+  Id json.RawMessage `json:"id,omitempty"`
+}
+
+// jsonRequestReader adapts a parsed jsonEnvelope to the RequestReader
+// interface, decoding params lazily once the method's ArgType is
+// known.
+type jsonRequestReader struct {
+  envelope jsonEnvelope
+}
+
+func (r *jsonRequestReader) Method() string { return r.envelope.Method }
+
+func (r *jsonRequestReader) Id() interface{} {
+  if r.envelope.Id == nil {
+    return nil
+  }
+  return r.envelope.Id
+}
+
+func (r *jsonRequestReader) Decode(into interface{}) error {
+  if len(r.envelope.Params) == 0 {
+    return nil
+  }
+  params := r.envelope.Params
+  // A positional batch of exactly one argument is also accepted.
+  if bytes.HasPrefix(bytes.TrimSpace(params), []byte("[")) {
+    var positional []json.RawMessage
+    if err := json.Unmarshal(params, &positional); err != nil || len(positional) != 1 {
+      return &codecError{code: invalidParamsCode, message: "Invalid params", id: r.Id()}
+    }
+    params = positional[0]
+  }
+  if err := json.Unmarshal(params, into); err != nil {
+    return &codecError{code: invalidParamsCode, message: "Invalid params", id: r.Id()}
+  }
+  return nil
+}
+
+// jsonCodec is the default Codec, registered by NewServer under
+// ContentTypeJSON.
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) NewRequest(r io.Reader) (RequestReader, error) {
+  data, err := ioutil.ReadAll(r)
+  if err != nil {
+    return nil, err
+  }
+  var envelope jsonEnvelope
+  if err := json.Unmarshal(data, &envelope); err != nil {
+    if _, ok := err.(*json.UnmarshalTypeError); ok {
+      // data is syntactically valid JSON (e.g. a bare number, string,
+      // or array) but isn't a Request object at all, which the spec
+      // calls out as Invalid Request rather than a parse error.
+      return nil, &codecError{code: invalidRequestCode, message: "Invalid Request"}
+    }
+    return nil, err
+  }
+  if envelope.Jsonrpc != jsonrpcVersion || envelope.Method == "" {
+    var id interface{}
+    if envelope.Id != nil {
+      id = envelope.Id
+    }
+    return nil, &codecError{code: invalidRequestCode, message: "Invalid Request", id: id}
+  }
+  return &jsonRequestReader{envelope: envelope}, nil
+}
+
+func (jsonCodec) WriteResponse(w io.Writer, id interface{}, result interface{}, rpcErr *rpcError) error {
+  rawId, _ := id.(json.RawMessage)
+  out, err := json.Marshal(&jsonResponse{
+    Jsonrpc: jsonrpcVersion,
+    Result:  result,
+    Error:   rpcErr,
+    Id:      rawId,
+  })
+  if err != nil {
+    return err
+  }
+  _, err = w.Write(out)
+  return err
+}
+
+func (jsonCodec) SplitBatch(body []byte) ([]io.Reader, bool, error) {
+  trimmed := bytes.TrimSpace(body)
+  if !bytes.HasPrefix(trimmed, []byte("[")) {
+    return nil, false, nil
+  }
+  var raw []json.RawMessage
+  if err := json.Unmarshal(trimmed, &raw); err != nil {
+    return nil, true, err
+  }
+  readers := make([]io.Reader, len(raw))
+  for i, r := range raw {
+    readers[i] = bytes.NewReader(r)
+  }
+  return readers, true, nil
+}
+
+func (jsonCodec) WriteBatchResponse(w io.Writer, responses []batchResult) error {
+  out := make([]*jsonResponse, 0, len(responses))
+  for _, rsp := range responses {
+    rawId, _ := rsp.id.(json.RawMessage)
+    out = append(out, &jsonResponse{
+      Jsonrpc: jsonrpcVersion,
+      Result:  rsp.result,
+      Error:   rsp.rpcErr,
+      Id:      rawId,
+    })
+  }
+  data, err := json.Marshal(out)
+  if err != nil {
+    return err
+  }
+  _, err = w.Write(data)
+  return err
+}
+
+// jsonResponse is the wire shape of a single JSON-RPC 2.0 response
+// object. Exactly one of Result or Error is set.
+type jsonResponse struct {
+  Jsonrpc string          `json:"jsonrpc"`
+  Result  interface{}     `json:"result,omitempty"`
+  Error   *rpcError       `json:"error,omitempty"`
+  Id      json.RawMessage `json:"id"`
+}
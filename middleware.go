@@ -0,0 +1,118 @@
+package httprpc
+
+import (
+  "context"
+  "crypto/hmac"
+  "fmt"
+  "log"
+  "runtime"
+  "time"
+)
+
+// Request is the handler-facing view of a resolved JSON-RPC call,
+// passed through the wrapper chain to each HandlerFunc.
+type Request struct {
+  Service string
+  Method  string
+  Args    interface{} // pointer to the method's decoded ArgType
+
+  mt *methodType // used by the built-in Metrics wrapper
+}
+
+// HandlerFunc performs one method invocation. rsp is a pointer to the
+// method's ReplyType, populated in place on success, or, for a
+// streaming method, the Stream the method sends its frames on.
+type HandlerFunc func(ctx context.Context, req Request, rsp interface{}) error
+
+// Wrapper adapts a HandlerFunc, e.g. to add logging, recovery, auth, or
+// metrics around every call. Wrappers are applied in the order they
+// were passed to Use, outermost first.
+type Wrapper func(HandlerFunc) HandlerFunc
+
+// Use appends wrappers to the server's chain. They run around every
+// registered method call, outermost first, in the order given.
+func (s *Server) Use(wrappers ...Wrapper) {
+  s.wrappers = append(s.wrappers, wrappers...)
+}
+
+// Error lets a wrapper report a specific JSON-RPC error code and
+// optional data (e.g. a stack trace), instead of falling back to the
+// generic server error code used for a plain error.
+type Error struct {
+  Code    int
+  Message string
+  Data    interface{}
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// Logging logs each call's method name and duration. It replaces the
+// ad-hoc log.Printf calls the server used to sprinkle through
+// ServeHTTP.
+func Logging() Wrapper {
+  return func(next HandlerFunc) HandlerFunc {
+    return func(ctx context.Context, req Request, rsp interface{}) error {
+      start := time.Now()
+      err := next(ctx, req, rsp)
+      log.Printf("%s.%s (%s): %v", req.Service, req.Method, time.Since(start), err)
+      return err
+    }
+  }
+}
+
+// Recover turns a panic inside a method call into a JSON-RPC internal
+// error, with the stack trace attached as the error's Data, instead of
+// taking down the server.
+func Recover() Wrapper {
+  return func(next HandlerFunc) HandlerFunc {
+    return func(ctx context.Context, req Request, rsp interface{}) (err error) {
+      defer func() {
+        if p := recover(); p != nil {
+          buf := make([]byte, 4096)
+          n := runtime.Stack(buf, false)
+          err = &Error{
+            Code:    internalErrorCode,
+            Message: fmt.Sprintf("panic: %v", p),
+            Data:    string(buf[:n]),
+          }
+        }
+      }()
+      return next(ctx, req, rsp)
+    }
+  }
+}
+
+// Metrics counts calls per method using the (until now dead)
+// methodType.numCalls counter.
+func Metrics() Wrapper {
+  return func(next HandlerFunc) HandlerFunc {
+    return func(ctx context.Context, req Request, rsp interface{}) error {
+      if req.mt != nil {
+        req.mt.Lock()
+        req.mt.numCalls++
+        req.mt.Unlock()
+      }
+      return next(ctx, req, rsp)
+    }
+  }
+}
+
+// unauthorizedErrorCode is a server error code (within the reserved
+// -32000..-32099 range) used by BearerAuth.
+const unauthorizedErrorCode = -32001
+
+// BearerAuth rejects any call whose "Authorization" header isn't
+// "Bearer <token>". The comparison is constant-time, since this is the
+// one auth primitive this package ships.
+func BearerAuth(token string) Wrapper {
+  want := []byte("Bearer " + token)
+  return func(next HandlerFunc) HandlerFunc {
+    return func(ctx context.Context, req Request, rsp interface{}) error {
+      headers, _ := HeadersFromContext(ctx)
+      if headers == nil || !hmac.Equal([]byte(headers.Get("Authorization")), want) {
+        return &Error{Code: unauthorizedErrorCode, Message: "Unauthorized"}
+      }
+      return next(ctx, req, rsp)
+    }
+  }
+}
@@ -0,0 +1,166 @@
+package httprpc
+
+import (
+  "fmt"
+  "reflect"
+  "sort"
+  "strings"
+)
+
+// reflectServiceName is the service name the built-in introspection
+// methods are registered under. It starts with an underscore, so it's
+// not an exported Go identifier and can't collide with the name of an
+// exported service type passed to Register.
+const reflectServiceName = "_reflect"
+
+// reflectService backs the "_reflect.ListServices" and
+// "_reflect.DescribeMethod" methods that every Server exposes unless
+// DisableReflection is called.
+type reflectService struct {
+  server *Server
+}
+
+type ListServicesArgs struct{}
+
+type ServiceDescription struct {
+  Name    string   `json:"name"`
+  Methods []string `json:"methods"`
+}
+
+type ListServicesReply struct {
+  Services []ServiceDescription `json:"services"`
+}
+
+// ListServices enumerates every registered service and its method
+// names, letting a client discover what it can call without an
+// out-of-band IDL.
+func (rs *reflectService) ListServices(args *ListServicesArgs, reply *ListServicesReply) error {
+  for name, svc := range rs.server.serviceMap {
+    if name == reflectServiceName {
+      continue
+    }
+    methods := make([]string, 0, len(svc.method))
+    for mname := range svc.method {
+      methods = append(methods, mname)
+    }
+    sort.Strings(methods)
+    reply.Services = append(reply.Services, ServiceDescription{Name: name, Methods: methods})
+  }
+  sort.Slice(reply.Services, func(i, j int) bool {
+    return reply.Services[i].Name < reply.Services[j].Name
+  })
+  return nil
+}
+
+type DescribeMethodArgs struct {
+  Service string `json:"service"`
+  Method  string `json:"method"`
+}
+
+type DescribeMethodReply struct {
+  Service   string      `json:"service"`
+  Method    string      `json:"method"`
+  Streaming bool        `json:"streaming"`
+  Args      *jsonSchema `json:"args"`
+  Reply     *jsonSchema `json:"reply,omitempty"`
+}
+
+// DescribeMethod returns JSON Schema fragments for one method's
+// argument and (unless it streams) reply types.
+func (rs *reflectService) DescribeMethod(args *DescribeMethodArgs, reply *DescribeMethodReply) error {
+  svc, ok := rs.server.serviceMap[args.Service]
+  if !ok {
+    return fmt.Errorf("no such service: %s", args.Service)
+  }
+  method, ok := svc.method[args.Method]
+  if !ok {
+    return fmt.Errorf("no such method: %s.%s", args.Service, args.Method)
+  }
+  reply.Service = args.Service
+  reply.Method = args.Method
+  reply.Streaming = method.isStream
+  reply.Args = schemaFor(method.ArgType, map[reflect.Type]bool{})
+  if !method.isStream {
+    reply.Reply = schemaFor(method.ReplyType, map[reflect.Type]bool{})
+  }
+  return nil
+}
+
+// jsonSchema is a (small) subset of JSON Schema, just enough to
+// describe the ArgType/ReplyType structs services are built from. Ref
+// is set instead of the rest of the fields when a struct recurses into
+// a type already being described higher up the same chain.
+type jsonSchema struct {
+  Type       string                 `json:"type,omitempty"`
+  Properties map[string]*jsonSchema `json:"properties,omitempty"`
+  Required   []string               `json:"required,omitempty"`
+  Items      *jsonSchema            `json:"items,omitempty"`
+  Ref        string                 `json:"$ref,omitempty"`
+}
+
+// schemaFor walks t, recursing into structs, slices, and arrays, and
+// honoring json tags the same way encoding/json would. inProgress
+// tracks struct types currently being described higher up the call
+// stack, so a type that recurses into itself (directly or through
+// another struct) emits a $ref marker instead of recursing forever.
+func schemaFor(t reflect.Type, inProgress map[reflect.Type]bool) *jsonSchema {
+  for t.Kind() == reflect.Ptr {
+    t = t.Elem()
+  }
+  switch t.Kind() {
+  case reflect.Struct:
+    if inProgress[t] {
+      return &jsonSchema{Ref: t.Name()}
+    }
+    return structSchema(t, inProgress)
+  case reflect.Slice, reflect.Array:
+    return &jsonSchema{Type: "array", Items: schemaFor(t.Elem(), inProgress)}
+  case reflect.Map:
+    return &jsonSchema{Type: "object"}
+  case reflect.String:
+    return &jsonSchema{Type: "string"}
+  case reflect.Bool:
+    return &jsonSchema{Type: "boolean"}
+  case reflect.Float32, reflect.Float64:
+    return &jsonSchema{Type: "number"}
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+    reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+    return &jsonSchema{Type: "integer"}
+  default:
+    return &jsonSchema{Type: "object"}
+  }
+}
+
+func structSchema(t reflect.Type, inProgress map[reflect.Type]bool) *jsonSchema {
+  inProgress[t] = true
+  defer delete(inProgress, t)
+
+  schema := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+  for i := 0; i < t.NumField(); i++ {
+    field := t.Field(i)
+    if field.PkgPath != "" {
+      continue // unexported
+    }
+    name := field.Name
+    optional := field.Type.Kind() == reflect.Ptr
+    if tag := field.Tag.Get("json"); tag != "" {
+      parts := strings.Split(tag, ",")
+      if parts[0] == "-" {
+        continue
+      }
+      if parts[0] != "" {
+        name = parts[0]
+      }
+      for _, opt := range parts[1:] {
+        if opt == "omitempty" {
+          optional = true
+        }
+      }
+    }
+    schema.Properties[name] = schemaFor(field.Type, inProgress)
+    if !optional {
+      schema.Required = append(schema.Required, name)
+    }
+  }
+  return schema
+}
@@ -1,37 +1,51 @@
 package httprpc
 
 import (
+  "bytes"
+  "context"
+  "io"
   "io/ioutil"
-  "os"
-  "json"
-  "strings"
-  "http"
   "log"
+  "mime"
+  "net/http"
   "reflect"
+  "strings"
   "sync"
-  "utf8"
+  "time"
   "unicode"
+  "unicode/utf8"
 )
 
-type Request struct {
-  Method string
-}
+// Standard JSON-RPC 2.0 error codes. Codes in -32000 to -32099 are
+// reserved for implementation-defined server errors; errors returned by
+// registered methods are surfaced using serverErrorCode below.
+const (
+  parseErrorCode     = -32700
+  invalidRequestCode = -32600
+  methodNotFoundCode = -32601
+  invalidParamsCode  = -32602
+  internalErrorCode  = -32603
+  serverErrorCode    = -32000
+)
 
-type Request2 struct {
-  Params interface{}
-  Id     string
-}
+const jsonrpcVersion = "2.0"
 
-type ErrorResponse struct {
-  Error string
+// rpcError is the wire-agnostic shape of a JSON-RPC 2.0 error; each
+// Codec is responsible for marshaling it in its own format.
+type rpcError struct {
+  Code    int         `json:"code"`
+  Message string      `json:"message"`
+  Data    interface{} `json:"data,omitempty"`
 }
 
 type methodType struct {
   sync.Mutex // protects counters
-  method     reflect.Method
-  ArgType    reflect.Type
-  ReplyType  reflect.Type
-  numCalls   uint
+  method       reflect.Method
+  ArgType      reflect.Type
+  ReplyType    reflect.Type // nil for streaming methods
+  wantsContext bool         // method's first arg (after the receiver) is context.Context
+  isStream     bool         // method's last arg is a Stream, not a *ReplyType
+  numCalls     uint
 }
 
 type service struct {
@@ -42,17 +56,47 @@ type service struct {
 }
 
 type Server struct {
-  serviceMap map[string]*service
+  serviceMap         map[string]*service
+  codecs             map[string]Codec
+  defaultContentType string
+  wrappers           []Wrapper
 }
 
 func NewServer() *Server {
-  return &Server{
-    serviceMap: make(map[string]*service),
+  s := &Server{
+    serviceMap:         make(map[string]*service),
+    codecs:             make(map[string]Codec),
+    defaultContentType: ContentTypeJSON,
   }
+  s.RegisterCodec(ContentTypeJSON, jsonCodec{})
+  s.registerAs(reflectServiceName, &reflectService{server: s})
+  return s
+}
+
+// DisableReflection unregisters the built-in "_reflect" introspection
+// service, so DescribeMethod/ListServices aren't exposed. Call it
+// before serving traffic in deployments that don't want registered
+// services to be discoverable over the wire.
+func (s *Server) DisableReflection() {
+  delete(s.serviceMap, reflectServiceName)
+}
+
+// RegisterCodec makes codec responsible for requests whose Content-Type
+// header is contentType (e.g. "application/bson", "application/x-protobuf",
+// "application/msgpack"), so a single Server can serve mixed clients.
+func (s *Server) RegisterCodec(contentType string, codec Codec) {
+  s.codecs[contentType] = codec
+}
+
+// SetDefaultContentType changes the codec used for requests that don't
+// send a Content-Type header, or send one with no registered codec.
+// contentType must already be registered via RegisterCodec (NewServer
+// registers ContentTypeJSON as the initial default).
+func (s *Server) SetDefaultContentType(contentType string) {
+  s.defaultContentType = contentType
 }
 
-var unusedError *os.Error
-var typeOfOsError = reflect.TypeOf(unusedError).Elem()
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 
 // Is this an exported - upper case - name?
 func isExported(name string) bool {
@@ -71,10 +115,18 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 }
 
 func (server *Server) Register(impl interface{}) {
+  server.registerAs(reflect.Indirect(reflect.ValueOf(impl)).Type().Name(), impl)
+}
+
+// registerAs registers impl under name, bypassing the usual
+// derive-the-name-from-the-type behavior of Register. It exists so the
+// built-in "_reflect" service (see reflect.go) can use a name that
+// isn't a valid exported Go identifier.
+func (server *Server) registerAs(name string, impl interface{}) {
   s := &service{}
   s.typ = reflect.TypeOf(impl)
   s.rcvr = reflect.ValueOf(impl)
-  s.name = reflect.Indirect(s.rcvr).Type().Name()
+  s.name = name
   s.method = make(map[string]*methodType)
 
   for m := 0; m < s.typ.NumMethod(); m++ {
@@ -84,13 +136,20 @@ func (server *Server) Register(impl interface{}) {
     if method.PkgPath != "" {
       continue
     }
-    // Method needs three ins: receiver, *args, *reply.
-    if mtype.NumIn() != 3 {
+    // Method needs three ins (receiver, *args, *reply), or four if the
+    // first in after the receiver is a context.Context (required for
+    // streaming methods, optional otherwise).
+    wantsContext := mtype.NumIn() == 4 && mtype.In(1) == typeOfContext
+    if mtype.NumIn() != 3 && !wantsContext {
       log.Println("method", mname, "has wrong number of ins:", mtype.NumIn())
       continue
     }
-    // First arg must be a pointer.
-    argType := mtype.In(1)
+    argIdx := 1
+    if wantsContext {
+      argIdx = 2
+    }
+    // The arg (just after the optional context) must be a pointer.
+    argType := mtype.In(argIdx)
     if argType.Kind() != reflect.Ptr {
       log.Println(mname, "argument type not a pointer:", argType)
       continue
@@ -99,83 +158,290 @@ func (server *Server) Register(impl interface{}) {
       log.Println(mname, "argument type not exported or local:", argType)
       continue
     }
-    // Second arg must be a pointer.
-    replyType := mtype.In(2)
-    if replyType.Kind() != reflect.Ptr {
-      log.Println("method", mname, "reply type not a pointer:", replyType)
+    // The last in is either *reply or a Stream.
+    lastType := mtype.In(argIdx + 1)
+    isStream := lastType == typeOfStream
+    if isStream && !wantsContext {
+      log.Println(mname, "streaming methods must take a context.Context")
       continue
     }
-    if !isExportedOrBuiltinType(replyType) {
-      log.Println("method", mname, "reply type not exported or local:", replyType)
-      continue
+    var replyType reflect.Type
+    if !isStream {
+      replyType = lastType
+      if replyType.Kind() != reflect.Ptr {
+        log.Println("method", mname, "reply type not a pointer:", replyType)
+        continue
+      }
+      if !isExportedOrBuiltinType(replyType) {
+        log.Println("method", mname, "reply type not exported or local:", replyType)
+        continue
+      }
     }
-    // Method needs one out: os.Error.
+    // Method needs one out: error.
     if mtype.NumOut() != 1 {
       log.Println("method", mname, "has wrong number of outs:", mtype.NumOut())
       continue
     }
-    if returnType := mtype.Out(0); returnType != typeOfOsError {
-      log.Println("method", mname, "returns", returnType.String(), "not os.Error")
+    if returnType := mtype.Out(0); returnType != typeOfError {
+      log.Println("method", mname, "returns", returnType.String(), "not error")
       continue
     }
-    s.method[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType}
+    s.method[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType, wantsContext: wantsContext, isStream: isStream}
   }
   server.serviceMap[s.name] = s
   log.Printf("%#v", s)
 }
 
+// CallCounts returns the number of times each registered method has
+// been called, keyed by "Service.Method", as counted by the Metrics
+// wrapper. Methods never called at all (or called before Metrics was
+// registered) are simply absent, not zero.
+func (s *Server) CallCounts() map[string]uint {
+  counts := make(map[string]uint)
+  for sname, svc := range s.serviceMap {
+    for mname, method := range svc.method {
+      method.Lock()
+      n := method.numCalls
+      method.Unlock()
+      if n > 0 {
+        counts[sname+"."+mname] = n
+      }
+    }
+  }
+  return counts
+}
+
+// lookupMethod resolves a "Service.Method" name to its service and
+// methodType.
+func (s *Server) lookupMethod(fullName string) (*service, *methodType, bool) {
+  sname := strings.SplitN(fullName, ".", 2)
+  if len(sname) != 2 {
+    return nil, nil, false
+  }
+  svc, ok := s.serviceMap[sname[0]]
+  if !ok {
+    return nil, nil, false
+  }
+  method, ok := svc.method[sname[1]]
+  if !ok {
+    return nil, nil, false
+  }
+  return svc, method, true
+}
+
+// dispatch resolves and invokes the method named by req, returning the
+// result (or rpcErr) to send back. The caller decides whether to reply
+// at all, since req.Id() == nil (a notification) still runs the method
+// for effect.
+func (s *Server) dispatch(ctx context.Context, req RequestReader) (result interface{}, rpcErr *rpcError) {
+  svc, method, ok := s.lookupMethod(req.Method())
+  if !ok {
+    return nil, &rpcError{Code: methodNotFoundCode, Message: "Method not found"}
+  }
+  if method.isStream {
+    // Streaming methods need a direct handle to the transport (chunked
+    // response or WebSocket) to emit frames as they're sent; ServeHTTP
+    // routes them to serveStream/serveWebSocket instead of here.
+    return nil, &rpcError{Code: invalidRequestCode, Message: "streaming methods are not supported in batch requests"}
+  }
+
+  // Prepare params; decoding is delegated to the codec so that e.g.
+  // protobuf-generated ArgTypes work without JSON tags.
+  argv := reflect.New(method.ArgType.Elem())
+  if err := req.Decode(argv.Interface()); err != nil {
+    if ce, ok := err.(*codecError); ok {
+      return nil, &rpcError{Code: ce.code, Message: ce.message}
+    }
+    return nil, &rpcError{Code: invalidParamsCode, Message: "Invalid params"}
+  }
+
+  // Prepare reply object.
+  replyv := reflect.New(method.ReplyType.Elem())
+
+  handler := s.buildHandler(svc, method, argv)
+  wrappedReq := Request{Service: svc.name, Method: method.method.Name, Args: argv.Interface(), mt: method}
+  if err := handler(ctx, wrappedReq, replyv.Interface()); err != nil {
+    return nil, errToRPCError(err)
+  }
+  return replyv.Interface(), nil
+}
+
+// buildHandler builds the terminal HandlerFunc for method (a plain
+// reflect.Call against svc.rcvr/ctx/argv/rsp), then wraps it with the
+// server's registered wrappers, outermost first. rsp is either a
+// pointer to the method's ReplyType (unary methods) or a Stream
+// (streaming methods) — both are just the method's last positional
+// arg as far as reflect.Call is concerned. Used by both dispatch and
+// the streaming paths in stream.go, so BearerAuth/Recover/Metrics/etc.
+// apply uniformly regardless of transport.
+func (s *Server) buildHandler(svc *service, method *methodType, argv reflect.Value) HandlerFunc {
+  handler := HandlerFunc(func(ctx context.Context, req Request, rsp interface{}) error {
+    function := method.method.Func
+    rspVal := reflect.ValueOf(rsp)
+    var callArgs []reflect.Value
+    if method.wantsContext {
+      callArgs = []reflect.Value{svc.rcvr, reflect.ValueOf(ctx), argv, rspVal}
+    } else {
+      callArgs = []reflect.Value{svc.rcvr, argv, rspVal}
+    }
+    returnVals := function.Call(callArgs)
+    if errInter := returnVals[0].Interface(); errInter != nil {
+      return errInter.(error)
+    }
+    return nil
+  })
+  for i := len(s.wrappers) - 1; i >= 0; i-- {
+    handler = s.wrappers[i](handler)
+  }
+  return handler
+}
+
+// errToRPCError turns the error a HandlerFunc chain returned into the
+// rpcError to send back, preserving the code/data a wrapper (e.g.
+// Recover, BearerAuth) set via *Error.
+func errToRPCError(err error) *rpcError {
+  if e, ok := err.(*Error); ok {
+    return &rpcError{Code: e.Code, Message: e.Message, Data: e.Data}
+  }
+  return &rpcError{Code: serverErrorCode, Message: err.Error()}
+}
+
+func (s *Server) codecFor(r *http.Request) Codec {
+  contentType := r.Header.Get("Content-Type")
+  if contentType != "" {
+    if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+      if codec, ok := s.codecs[mediaType]; ok {
+        return codec
+      }
+    }
+  }
+  return s.codecs[s.defaultContentType]
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-  w.Header().Set("Content-Type", "application/json")
+  // r.Context() is already canceled by net/http when the client
+  // disconnects; layer the request headers on top of it.
+  baseCtx := withHeaders(r.Context(), r.Header)
+
+  if isWebSocketUpgrade(r) {
+    // Bidirectional: every inbound message is its own JSON-RPC call,
+    // dispatched over the connection's lifetime, so the one
+    // X-RPC-Timeout header sent with the handshake can't be turned
+    // into a deadline here — it would apply to every message the
+    // connection ever carries, not the individual call it named.
+    // serveWebSocket derives each message's own context instead.
+    s.serveWebSocket(baseCtx).ServeHTTP(w, r)
+    return
+  }
+
+  // A per-request deadline only makes sense for a single call, so it's
+  // layered on after the WebSocket branch above.
+  if timeout := r.Header.Get("X-RPC-Timeout"); timeout != "" {
+    if d, err := time.ParseDuration(timeout); err == nil {
+      var cancel context.CancelFunc
+      baseCtx, cancel = context.WithTimeout(baseCtx, d)
+      defer cancel()
+    }
+  }
+
   w.Header().Set("Access-Control-Allow-Origin", "*")
   w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
   w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-  log.Printf("----------------\n")
-  req := &Request{}
+  codec := s.codecFor(r)
+  w.Header().Set("Content-Type", codec.ContentType())
+
   data, err := ioutil.ReadAll(r.Body)
   if err != nil {
-    log.Println(err.String())
+    log.Println(err.Error())
+    codec.WriteResponse(w, nil, nil, &rpcError{Code: parseErrorCode, Message: "Parse error"})
     return
   }
-  json.Unmarshal(data, req)
-  log.Printf("Request: %#v", req)
-  // Find the receiver object.
-  sname := strings.Split(req.Method, ".")
-  service, ok := s.serviceMap[sname[0]]
-  if !ok || len(sname) != 2 {
-    log.Println("No such service")
-    return
+
+  var readers []io.Reader
+  batch := false
+  if bc, ok := codec.(BatchCodec); ok {
+    var splitErr error
+    readers, batch, splitErr = bc.SplitBatch(data)
+    if splitErr != nil {
+      codec.WriteResponse(w, nil, nil, &rpcError{Code: parseErrorCode, Message: "Parse error"})
+      return
+    }
+    if batch && len(readers) == 0 {
+      codec.WriteResponse(w, nil, nil, &rpcError{Code: invalidRequestCode, Message: "Invalid Request"})
+      return
+    }
   }
-  // Find the method.
-  method, ok := service.method[sname[1]]
-  if !ok {
-    log.Println("No such method")
+  if !batch {
+    // Not a batch: handle synchronously so a streaming method can hold
+    // the response open and write frames as it sends them, rather than
+    // being forced through the single-buffered-result model batches use.
+    req, err := codec.NewRequest(bytes.NewReader(data))
+    if err != nil {
+      if ce, ok := err.(*codecError); ok {
+        codec.WriteResponse(w, ce.id, nil, &rpcError{Code: ce.code, Message: ce.message})
+        return
+      }
+      codec.WriteResponse(w, nil, nil, &rpcError{Code: parseErrorCode, Message: "Parse error"})
+      return
+    }
+    if svc, method, ok := s.lookupMethod(req.Method()); ok && method.isStream {
+      s.serveStream(w, withRequestId(baseCtx, req.Id()), svc, method, req)
+      return
+    }
+    ctx := withRequestId(baseCtx, req.Id())
+    result, rpcErr := s.dispatch(ctx, req)
+    if req.Id() == nil {
+      w.WriteHeader(http.StatusNoContent)
+      return
+    }
+    codec.WriteResponse(w, req.Id(), result, rpcErr)
     return
   }
-  function := method.method.Func
 
-  // Prepare params.
-  argv := reflect.New(method.ArgType.Elem())
-  req2 := &Request2{Params: argv.Internal}
-  // Parse params (again, could be improved...)
-  json.Unmarshal(data, req2)
+  // Batch entries are dispatched concurrently; responses are collected
+  // back into the original order.
+  type outcome struct {
+    notify bool
+    result batchResult
+  }
+  outcomes := make([]outcome, len(readers))
+  var wg sync.WaitGroup
+  wg.Add(len(readers))
+  for i, rd := range readers {
+    go func(i int, rd io.Reader) {
+      defer wg.Done()
+      req, err := codec.NewRequest(rd)
+      if err != nil {
+        if ce, ok := err.(*codecError); ok {
+          outcomes[i] = outcome{result: batchResult{id: ce.id, rpcErr: &rpcError{Code: ce.code, Message: ce.message}}}
+          return
+        }
+        outcomes[i] = outcome{result: batchResult{rpcErr: &rpcError{Code: parseErrorCode, Message: "Parse error"}}}
+        return
+      }
+      ctx := withRequestId(baseCtx, req.Id())
+      result, rpcErr := s.dispatch(ctx, req)
+      if req.Id() == nil {
+        outcomes[i] = outcome{notify: true}
+        return
+      }
+      outcomes[i] = outcome{result: batchResult{id: req.Id(), result: result, rpcErr: rpcErr}}
+    }(i, rd)
+  }
+  wg.Wait()
 
-  // Prepare reply object.
-  replyv := reflect.New(method.ReplyType.Elem())
-  // Call the function
-  returnVals := function.Call([]reflect.Value{service.rcvr, argv, replyv})
-
-  // Check for error returned.
-  errInter := returnVals[0].Interface()
-  errmsg := ""
-  out := make([]byte, 0, 0)
-  if errInter != nil {
-    errmsg = errInter.(os.Error).String()
-    out, _ = json.Marshal(ErrorResponse{errmsg})
-  } else {
-    out, _ = json.Marshal(replyv.Internal)
-  }
-  // Write output.
-  log.Printf(string(out))
-  w.Write(out)
+  results := make([]batchResult, 0, len(outcomes))
+  for _, o := range outcomes {
+    if !o.notify {
+      results = append(results, o.result)
+    }
+  }
+
+  if len(results) == 0 {
+    // An all-notification batch: nothing to say.
+    w.WriteHeader(http.StatusNoContent)
+    return
+  }
+  codec.(BatchCodec).WriteBatchResponse(w, results)
 }
@@ -0,0 +1,255 @@
+package httprpc
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  "golang.org/x/net/websocket"
+)
+
+type EchoArgs struct {
+  Text string `json:"text"`
+}
+
+type EchoReply struct {
+  Text string `json:"text"`
+}
+
+type EchoService struct{}
+
+func (EchoService) Echo(args *EchoArgs, reply *EchoReply) error {
+  reply.Text = args.Text
+  return nil
+}
+
+func (EchoService) Stream(ctx context.Context, args *EchoArgs, stream Stream) error {
+  return stream.Send(&EchoReply{Text: args.Text})
+}
+
+func (EchoService) StreamThenClose(ctx context.Context, args *EchoArgs, stream Stream) error {
+  if err := stream.Send(&EchoReply{Text: args.Text}); err != nil {
+    return err
+  }
+  return stream.Close()
+}
+
+// CtxErr reports ctx.Err(), so a test can tell whether the context the
+// method ran with was already canceled/expired when it started.
+func (EchoService) CtxErr(ctx context.Context, args *EchoArgs, reply *EchoReply) error {
+  reply.Text = fmt.Sprint(ctx.Err())
+  return nil
+}
+
+func newEchoServer() *Server {
+  s := NewServer()
+  s.Register(EchoService{})
+  return s
+}
+
+func doRequest(t *testing.T, s *Server, body string) *httptest.ResponseRecorder {
+  t.Helper()
+  req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+  req.Header.Set("Content-Type", ContentTypeJSON)
+  rec := httptest.NewRecorder()
+  s.ServeHTTP(rec, req)
+  return rec
+}
+
+func TestBatchPreservesOrder(t *testing.T) {
+  s := newEchoServer()
+  body := `[
+    {"jsonrpc":"2.0","method":"EchoService.Echo","params":{"text":"one"},"id":1},
+    {"jsonrpc":"2.0","method":"EchoService.Echo","params":{"text":"two"},"id":2},
+    {"jsonrpc":"2.0","method":"EchoService.Echo","params":{"text":"three"},"id":3}
+  ]`
+  rec := doRequest(t, s, body)
+
+  var responses []struct {
+    Id     int       `json:"id"`
+    Result EchoReply `json:"result"`
+  }
+  if err := json.Unmarshal(rec.Body.Bytes(), &responses); err != nil {
+    t.Fatalf("unmarshal batch response: %v", err)
+  }
+  if len(responses) != 3 {
+    t.Fatalf("got %d responses, want 3", len(responses))
+  }
+  want := []string{"one", "two", "three"}
+  for i, w := range want {
+    if responses[i].Id != i+1 || responses[i].Result.Text != w {
+      t.Errorf("response %d = %+v, want id=%d text=%q", i, responses[i], i+1, w)
+    }
+  }
+}
+
+func TestBatchOfNonRequestObjectsIsInvalidRequest(t *testing.T) {
+  s := newEchoServer()
+  rec := doRequest(t, s, `[1,2,3]`)
+
+  var responses []struct {
+    Error *rpcError `json:"error"`
+  }
+  if err := json.Unmarshal(rec.Body.Bytes(), &responses); err != nil {
+    t.Fatalf("unmarshal batch response: %v", err)
+  }
+  if len(responses) != 3 {
+    t.Fatalf("got %d responses, want 3", len(responses))
+  }
+  for i, r := range responses {
+    if r.Error == nil || r.Error.Code != invalidRequestCode {
+      t.Errorf("response %d error = %+v, want code %d", i, r.Error, invalidRequestCode)
+    }
+  }
+}
+
+func TestExplicitNullIdGetsAResponse(t *testing.T) {
+  s := newEchoServer()
+  rec := doRequest(t, s, `{"jsonrpc":"2.0","method":"EchoService.Echo","params":{"text":"hi"},"id":null}`)
+  if rec.Code != http.StatusOK {
+    t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+  }
+
+  var resp struct {
+    Id     *string   `json:"id"`
+    Result EchoReply `json:"result"`
+  }
+  if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+    t.Fatalf("unmarshal response: %v", err)
+  }
+  if resp.Id != nil {
+    t.Errorf("id = %v, want null", *resp.Id)
+  }
+  if resp.Result.Text != "hi" {
+    t.Errorf("result = %+v, want text=hi", resp.Result)
+  }
+}
+
+// TestMethodClosingItsOwnStreamDoesNotDoubleEOF is a regression test
+// for the framework's trailing Close() call double-sending the EOF
+// sentinel when a method already closed the stream itself.
+func TestMethodClosingItsOwnStreamDoesNotDoubleEOF(t *testing.T) {
+  s := newEchoServer()
+  rec := doRequest(t, s, `{"jsonrpc":"2.0","method":"EchoService.StreamThenClose","params":{"text":"hi"},"id":1}`)
+
+  lines := bytes.Split(bytes.TrimSpace(rec.Body.Bytes()), []byte("\n"))
+  eofCount := 0
+  for _, line := range lines {
+    var frame struct {
+      StreamState string `json:"stream"`
+    }
+    if err := json.Unmarshal(line, &frame); err != nil {
+      t.Fatalf("unmarshal frame %q: %v", line, err)
+    }
+    if frame.StreamState == "EOF" {
+      eofCount++
+    }
+  }
+  if eofCount != 1 {
+    t.Fatalf("got %d EOF frames in %q, want 1", eofCount, rec.Body.String())
+  }
+}
+
+func TestNotificationIsSuppressed(t *testing.T) {
+  s := newEchoServer()
+  rec := doRequest(t, s, `{"jsonrpc":"2.0","method":"EchoService.Echo","params":{"text":"hi"}}`)
+  if rec.Code != http.StatusNoContent {
+    t.Fatalf("notification status = %d, want %d", rec.Code, http.StatusNoContent)
+  }
+  if rec.Body.Len() != 0 {
+    t.Fatalf("notification body = %q, want empty", rec.Body.String())
+  }
+}
+
+func TestMethodNotFound(t *testing.T) {
+  s := newEchoServer()
+  rec := doRequest(t, s, `{"jsonrpc":"2.0","method":"EchoService.Nope","params":{},"id":1}`)
+
+  var resp struct {
+    Error *rpcError `json:"error"`
+  }
+  if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+    t.Fatalf("unmarshal response: %v", err)
+  }
+  if resp.Error == nil || resp.Error.Code != methodNotFoundCode {
+    t.Fatalf("error = %+v, want code %d", resp.Error, methodNotFoundCode)
+  }
+}
+
+// TestWebSocketMessagesGetFreshContext is a regression test for a
+// single X-RPC-Timeout deadline set at WebSocket handshake time being
+// reused, already-expired, for every later message on that connection.
+func TestWebSocketMessagesGetFreshContext(t *testing.T) {
+  httpServer := httptest.NewServer(newEchoServer())
+  defer httpServer.Close()
+
+  wsURL := "ws://" + strings.TrimPrefix(httpServer.URL, "http://")
+  config, err := websocket.NewConfig(wsURL, httpServer.URL)
+  if err != nil {
+    t.Fatalf("NewConfig: %v", err)
+  }
+  config.Header.Set("X-RPC-Timeout", "50ms")
+  ws, err := websocket.DialConfig(config)
+  if err != nil {
+    t.Fatalf("DialConfig: %v", err)
+  }
+  defer ws.Close()
+
+  // Long enough that a deadline anchored to the handshake, rather than
+  // to this call, would already have expired.
+  time.Sleep(100 * time.Millisecond)
+
+  if err := websocket.Message.Send(ws, `{"jsonrpc":"2.0","method":"EchoService.CtxErr","params":{},"id":1}`); err != nil {
+    t.Fatalf("Send: %v", err)
+  }
+  var raw string
+  if err := websocket.Message.Receive(ws, &raw); err != nil {
+    t.Fatalf("Receive: %v", err)
+  }
+  var resp struct {
+    Result EchoReply `json:"result"`
+    Error  *rpcError `json:"error"`
+  }
+  if err := json.Unmarshal([]byte(raw), &resp); err != nil {
+    t.Fatalf("unmarshal response %q: %v", raw, err)
+  }
+  if resp.Error != nil {
+    t.Fatalf("error = %+v, want none", resp.Error)
+  }
+  if resp.Result.Text != "<nil>" {
+    t.Fatalf("ctx.Err() = %q, want %q (not canceled)", resp.Result.Text, "<nil>")
+  }
+}
+
+// TestBearerAuthRejectsStreaming is a regression test for the
+// streaming dispatch path bypassing the wrapper chain: before
+// serveStream/handleWSMessage were routed through buildHandler, a
+// streaming method ran unauthenticated even with BearerAuth
+// registered.
+func TestBearerAuthRejectsStreaming(t *testing.T) {
+  s := newEchoServer()
+  s.Use(BearerAuth("secret"))
+
+  req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(
+    []byte(`{"jsonrpc":"2.0","method":"EchoService.Stream","params":{"text":"hi"},"id":1}`)))
+  req.Header.Set("Content-Type", ContentTypeJSON)
+  rec := httptest.NewRecorder()
+  s.ServeHTTP(rec, req)
+
+  firstLine, _, _ := bytes.Cut(rec.Body.Bytes(), []byte("\n"))
+  var frame struct {
+    Error *rpcError `json:"error"`
+  }
+  if err := json.Unmarshal(firstLine, &frame); err != nil {
+    t.Fatalf("unmarshal stream frame: %v", err)
+  }
+  if frame.Error == nil || frame.Error.Code != unauthorizedErrorCode {
+    t.Fatalf("error = %+v, want code %d", frame.Error, unauthorizedErrorCode)
+  }
+}
@@ -0,0 +1,226 @@
+package httprpc
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "log"
+  "net/http"
+  "reflect"
+  "strings"
+  "sync"
+
+  "golang.org/x/net/websocket"
+)
+
+// Stream is implemented by the per-call object passed to streaming
+// methods, i.e. those shaped
+// func (t *T) Method(ctx context.Context, args *A, stream Stream) error.
+// Each Send is framed as its own JSON-RPC 2.0 response object; the
+// method closes the stream (directly, or via the server once it
+// returns) to emit the terminating sentinel frame.
+type Stream interface {
+  Send(v interface{}) error
+  Close() error
+}
+
+var typeOfStream = reflect.TypeOf((*Stream)(nil)).Elem()
+
+// streamFrame is one frame of a streamed response: either a result, an
+// error, or (once StreamState is "EOF") the terminating sentinel.
+type streamFrame struct {
+  Jsonrpc     string      `json:"jsonrpc"`
+  Result      interface{} `json:"result,omitempty"`
+  Error       *rpcError   `json:"error,omitempty"`
+  Id          interface{} `json:"id"`
+  StreamState string      `json:"stream,omitempty"`
+}
+
+// chunkedStream streams frames as newline-delimited JSON over a
+// chunked HTTP response.
+type chunkedStream struct {
+  w      http.ResponseWriter
+  id     interface{}
+  closed sync.Once
+}
+
+func (s *chunkedStream) Send(v interface{}) error {
+  return s.writeFrame(streamFrame{Jsonrpc: jsonrpcVersion, Result: v, Id: s.id})
+}
+
+// Close emits the terminating EOF sentinel frame. It's part of the
+// Stream interface so a method can close the stream itself once it's
+// done sending, but the server also calls it once the method returns
+// (see serveStream/handleWSMessage), so a second call here is a no-op
+// rather than a second EOF frame on the wire.
+func (s *chunkedStream) Close() error {
+  var err error
+  s.closed.Do(func() {
+    err = s.writeFrame(streamFrame{Jsonrpc: jsonrpcVersion, Id: s.id, StreamState: "EOF", Result: json.RawMessage("null")})
+  })
+  return err
+}
+
+func (s *chunkedStream) writeFrame(v interface{}) error {
+  out, err := json.Marshal(v)
+  if err != nil {
+    return err
+  }
+  if _, err := s.w.Write(append(out, '\n')); err != nil {
+    return err
+  }
+  if f, ok := s.w.(http.Flusher); ok {
+    f.Flush()
+  }
+  return nil
+}
+
+// serveStream invokes a streaming method, writing one frame per Send
+// directly to w as it happens instead of buffering a single response.
+func (s *Server) serveStream(w http.ResponseWriter, ctx context.Context, svc *service, method *methodType, req RequestReader) {
+  w.Header().Set("Content-Type", ContentTypeJSON)
+  w.Header().Set("Transfer-Encoding", "chunked")
+
+  argv := reflect.New(method.ArgType.Elem())
+  if err := req.Decode(argv.Interface()); err != nil {
+    writeStreamFrame(w, streamFrame{Jsonrpc: jsonrpcVersion, Id: req.Id(), Error: &rpcError{Code: invalidParamsCode, Message: "Invalid params"}})
+    return
+  }
+
+  stream := &chunkedStream{w: w, id: req.Id()}
+  handler := s.buildHandler(svc, method, argv)
+  wrappedReq := Request{Service: svc.name, Method: method.method.Name, Args: argv.Interface(), mt: method}
+  if err := handler(ctx, wrappedReq, stream); err != nil {
+    stream.writeFrame(streamFrame{Jsonrpc: jsonrpcVersion, Id: req.Id(), Error: errToRPCError(err)})
+  }
+  stream.Close()
+}
+
+func writeStreamFrame(w http.ResponseWriter, f streamFrame) {
+  out, err := json.Marshal(f)
+  if err != nil {
+    log.Println(err.Error())
+    return
+  }
+  w.Write(append(out, '\n'))
+}
+
+// wsStream is a Stream backed by a WebSocket connection: each Send is
+// one outbound WebSocket message.
+type wsStream struct {
+  ws     *websocket.Conn
+  id     interface{}
+  closed sync.Once
+}
+
+func (s *wsStream) Send(v interface{}) error {
+  return s.writeFrame(streamFrame{Jsonrpc: jsonrpcVersion, Result: v, Id: s.id})
+}
+
+// Close emits the terminating EOF sentinel frame; see chunkedStream.Close.
+func (s *wsStream) Close() error {
+  var err error
+  s.closed.Do(func() {
+    err = s.writeFrame(streamFrame{Jsonrpc: jsonrpcVersion, Id: s.id, StreamState: "EOF", Result: json.RawMessage("null")})
+  })
+  return err
+}
+
+func (s *wsStream) writeFrame(v interface{}) error {
+  out, err := json.Marshal(v)
+  if err != nil {
+    return err
+  }
+  return websocket.Message.Send(s.ws, string(out))
+}
+
+// isWebSocketUpgrade reports whether r is asking to upgrade the
+// connection to the WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+  return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWebSocket upgrades the connection and treats every inbound
+// WebSocket message as one JSON-RPC request, dispatched on its own
+// goroutine so a slow call doesn't block the others; a streaming
+// method's Sends and a unary method's single reply are both written
+// back as outbound WebSocket messages, so bidirectional streams work
+// over the same connection.
+func (s *Server) serveWebSocket(ctx context.Context) http.Handler {
+  srv := &websocket.Server{
+    // Accept connections from any origin, matching the permissive CORS
+    // policy of the plain HTTP endpoint.
+    Handshake: func(*websocket.Config, *http.Request) error { return nil },
+    Handler: func(ws *websocket.Conn) {
+      for {
+        var raw string
+        if err := websocket.Message.Receive(ws, &raw); err != nil {
+          return
+        }
+        go s.handleWSMessage(ctx, ws, []byte(raw))
+      }
+    },
+  }
+  return srv
+}
+
+// handleWSMessage dispatches one inbound WebSocket message. It runs on
+// its own goroutine per message (see serveWebSocket), so a panic here
+// that escaped the wrapper chain (e.g. because Recover() wasn't
+// registered) would otherwise take down the whole process instead of
+// just this connection; recover defensively and report it as an
+// internal error frame instead.
+func (s *Server) handleWSMessage(ctx context.Context, ws *websocket.Conn, raw []byte) {
+  var id interface{}
+  defer func() {
+    if p := recover(); p != nil {
+      log.Println("recovered panic in WebSocket handler:", p)
+      websocket.Message.Send(ws, mustMarshal(streamFrame{Jsonrpc: jsonrpcVersion, Id: id, Error: &rpcError{Code: internalErrorCode, Message: "Internal error"}}))
+    }
+  }()
+
+  codec := jsonCodec{}
+  req, err := codec.NewRequest(bytes.NewReader(raw))
+  if err != nil {
+    if ce, ok := err.(*codecError); ok {
+      websocket.Message.Send(ws, mustMarshal(streamFrame{Jsonrpc: jsonrpcVersion, Id: ce.id, Error: &rpcError{Code: ce.code, Message: ce.message}}))
+      return
+    }
+    websocket.Message.Send(ws, mustMarshal(streamFrame{Jsonrpc: jsonrpcVersion, Error: &rpcError{Code: parseErrorCode, Message: "Parse error"}}))
+    return
+  }
+
+  id = req.Id()
+  reqCtx := withRequestId(ctx, req.Id())
+  svc, method, ok := s.lookupMethod(req.Method())
+  if ok && method.isStream {
+    argv := reflect.New(method.ArgType.Elem())
+    if err := req.Decode(argv.Interface()); err != nil {
+      websocket.Message.Send(ws, mustMarshal(streamFrame{Jsonrpc: jsonrpcVersion, Id: req.Id(), Error: &rpcError{Code: invalidParamsCode, Message: "Invalid params"}}))
+      return
+    }
+    stream := &wsStream{ws: ws, id: req.Id()}
+    handler := s.buildHandler(svc, method, argv)
+    wrappedReq := Request{Service: svc.name, Method: method.method.Name, Args: argv.Interface(), mt: method}
+    if err := handler(reqCtx, wrappedReq, stream); err != nil {
+      stream.writeFrame(streamFrame{Jsonrpc: jsonrpcVersion, Id: req.Id(), Error: errToRPCError(err)})
+    }
+    stream.Close()
+    return
+  }
+
+  result, rpcErr := s.dispatch(reqCtx, req)
+  if req.Id() == nil {
+    return // notification: no reply
+  }
+  websocket.Message.Send(ws, mustMarshal(streamFrame{Jsonrpc: jsonrpcVersion, Result: result, Error: rpcErr, Id: req.Id()}))
+}
+
+func mustMarshal(v interface{}) string {
+  out, err := json.Marshal(v)
+  if err != nil {
+    log.Println(err.Error())
+    return ""
+  }
+  return string(out)
+}